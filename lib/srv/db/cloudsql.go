@@ -0,0 +1,119 @@
+/*
+Copyright 2020 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package db
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/gravitational/teleport/lib/services"
+
+	"github.com/gravitational/trace"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+	"google.golang.org/api/option"
+	"google.golang.org/api/sqladmin/v1beta4"
+)
+
+// initGCPCloudSQL downloads and caches the server CA certificate for server
+// if it's a Postgres database backed by GCP Cloud SQL IAM authentication,
+// lazily creating the shared CloudSQLClient on first use unless one was
+// already supplied via Config (e.g. a fake injected by a test).
+func (s *Server) initGCPCloudSQL(ctx context.Context, server services.DatabaseServer) error {
+	db := server.GetGCPCloudSQL()
+	if db == nil {
+		return nil // Not a Cloud SQL database, nothing to do.
+	}
+	if s.CloudSQLClient == nil {
+		client, err := newCloudSQLClient(ctx)
+		if err != nil {
+			return trace.Wrap(err)
+		}
+		s.CloudSQLClient = client
+	}
+	cert, err := s.CloudSQLClient.GetServerCert(ctx, db)
+	if err != nil {
+		return trace.Wrap(err)
+	}
+	s.gcpCACerts[server.GetName()] = cert
+	return nil
+}
+
+// CloudSQLClient defines an interface for obtaining the information needed
+// to connect to a GCP Cloud SQL Postgres instance using IAM authentication:
+// the instance's server CA certificate and a short-lived OAuth2 access token
+// to use as the Postgres password. Kept as an interface so tests can inject
+// a fake that returns canned values instead of talking to GCP.
+type CloudSQLClient interface {
+	// GetServerCert returns the PEM-encoded CA certificate GCP uses to sign
+	// the Cloud SQL instance's server certificate.
+	GetServerCert(ctx context.Context, db *services.GCPCloudSQL) ([]byte, error)
+	// GetAccessToken returns a fresh OAuth2 access token for the service
+	// account to use as the Postgres password.
+	GetAccessToken(ctx context.Context, db *services.GCPCloudSQL) (string, error)
+}
+
+// cloudSQLClient is the real CloudSQLClient implementation backed by the
+// Cloud SQL Admin API and Application Default Credentials.
+type cloudSQLClient struct {
+	tokenSource oauth2.TokenSource
+}
+
+// newCloudSQLClient creates a CloudSQLClient that obtains tokens via
+// Application Default Credentials, refreshing them before they expire.
+func newCloudSQLClient(ctx context.Context) (CloudSQLClient, error) {
+	scoped, err := google.DefaultTokenSource(ctx, sqladmin.SqlserviceAdminScope)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	return &cloudSQLClient{tokenSource: scoped}, nil
+}
+
+// GetServerCert downloads the instance's server CA certificate from the
+// Cloud SQL Admin API.
+func (c *cloudSQLClient) GetServerCert(ctx context.Context, db *services.GCPCloudSQL) ([]byte, error) {
+	service, err := sqladmin.NewService(ctx, option.WithTokenSource(oauth2.ReuseTokenSource(nil, c.tokenSource)))
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	instance, err := service.Instances.Get(db.ProjectID, db.InstanceID).Context(ctx).Do()
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	if instance.ServerCaCert == nil {
+		return nil, trace.NotFound("instance %v/%v has no server CA certificate",
+			db.ProjectID, db.InstanceID)
+	}
+	return []byte(instance.ServerCaCert.Cert), nil
+}
+
+// GetAccessToken returns a fresh access token to use as the Postgres
+// password for IAM database authentication.
+func (c *cloudSQLClient) GetAccessToken(ctx context.Context, db *services.GCPCloudSQL) (string, error) {
+	token, err := c.tokenSource.Token()
+	if err != nil {
+		return "", trace.Wrap(err)
+	}
+	return token.AccessToken, nil
+}
+
+// cloudSQLInstanceURI returns the GCP Cloud SQL instance URI
+// (gcp:project:region:instance) a services.Database with a GCP field
+// resolves to.
+func cloudSQLInstanceURI(db *services.GCPCloudSQL) string {
+	return fmt.Sprintf("gcp:%v:%v:%v", db.ProjectID, db.Region, db.InstanceID)
+}
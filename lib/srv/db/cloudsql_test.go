@@ -0,0 +1,84 @@
+/*
+Copyright 2020 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package db
+
+import (
+	"context"
+	"testing"
+
+	"github.com/gravitational/teleport/lib/services"
+
+	"github.com/stretchr/testify/require"
+)
+
+// fakeCloudSQLClient is a CloudSQLClient that returns canned values instead
+// of calling out to GCP, for use in tests.
+type fakeCloudSQLClient struct {
+	cert  []byte
+	token string
+}
+
+func (f *fakeCloudSQLClient) GetServerCert(ctx context.Context, db *services.GCPCloudSQL) ([]byte, error) {
+	return f.cert, nil
+}
+
+func (f *fakeCloudSQLClient) GetAccessToken(ctx context.Context, db *services.GCPCloudSQL) (string, error) {
+	return f.token, nil
+}
+
+// fakeGCPCloudSQLServer is a services.DatabaseServer that only implements
+// the methods initGCPCloudSQL actually calls. It embeds the interface
+// (left nil) so it still satisfies the type without having to stub out
+// every other accessor services.DatabaseServer exposes.
+type fakeGCPCloudSQLServer struct {
+	services.DatabaseServer
+	name string
+	db   *services.GCPCloudSQL
+}
+
+func (f *fakeGCPCloudSQLServer) GetName() string                      { return f.name }
+func (f *fakeGCPCloudSQLServer) GetGCPCloudSQL() *services.GCPCloudSQL { return f.db }
+
+// TestCloudSQLAccess verifies that Server.initGCPCloudSQL, given a database
+// server backed by GCP Cloud SQL, uses the injected CloudSQLClient (instead
+// of always constructing one backed by real Application Default
+// Credentials) to fetch and cache the server CA certificate.
+func TestCloudSQLAccess(t *testing.T) {
+	ctx := context.Background()
+	client := &fakeCloudSQLClient{cert: []byte("fake-ca-cert"), token: "fake-access-token"}
+	s := &Server{
+		Config:     Config{CloudSQLClient: client},
+		gcpCACerts: make(map[string][]byte),
+	}
+
+	db := &services.GCPCloudSQL{ProjectID: "test-project", Region: "us-central1", InstanceID: "test-instance"}
+	server := &fakeGCPCloudSQLServer{name: "cloudsql-test", db: db}
+
+	require.NoError(t, s.initGCPCloudSQL(ctx, server))
+	require.Equal(t, []byte("fake-ca-cert"), s.gcpCACerts[server.GetName()],
+		"initGCPCloudSQL should have cached the cert returned by the injected CloudSQLClient")
+
+	// initGCPCloudSQL must not have replaced the injected client with a real
+	// one backed by Application Default Credentials.
+	require.Same(t, client, s.CloudSQLClient)
+
+	token, err := s.CloudSQLClient.GetAccessToken(ctx, db)
+	require.NoError(t, err)
+	require.Equal(t, "fake-access-token", token)
+
+	require.Equal(t, "gcp:test-project:us-central1:test-instance", cloudSQLInstanceURI(db))
+}
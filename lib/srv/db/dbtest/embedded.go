@@ -0,0 +1,166 @@
+/*
+Copyright 2020 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package dbtest provides test helpers for exercising the database access
+// subsystem against real database engines instead of protocol mocks.
+package dbtest
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/gravitational/trace"
+	embeddedpostgres "github.com/fergusstrange/embedded-postgres"
+	"github.com/jackc/pgconn"
+)
+
+// EmbeddedPostgres is a real Postgres instance started for tests, along with
+// the TLS certificate it's serving so it can be wired into a db.Server as a
+// services.DatabaseServer backend.
+type EmbeddedPostgres struct {
+	// Addr is the host:port the instance is listening on.
+	Addr string
+	// TLSCert is the server certificate the instance presents, generated
+	// with the CommonName "localhost".
+	TLSCert tls.Certificate
+
+	instance *embeddedpostgres.EmbeddedPostgres
+}
+
+// Close stops the embedded instance.
+func (e *EmbeddedPostgres) Close() error {
+	return trace.Wrap(e.instance.Stop())
+}
+
+// NewEmbeddedPostgres boots a real Postgres on a random port with a
+// generated server certificate and a temporary data directory, and returns
+// a handle to it. Callers are responsible for calling Close when done.
+func NewEmbeddedPostgres(ctx context.Context, dataDir string) (*EmbeddedPostgres, error) {
+	port, err := freePort()
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+
+	cert, certPath, keyPath, err := generateServerCert(dataDir)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+
+	instance := embeddedpostgres.NewDatabase(embeddedpostgres.DefaultConfig().
+		Port(uint32(port)).
+		DataPath(dataDir).
+		StartParameters(map[string]string{
+			"ssl":           "on",
+			"ssl_cert_file": certPath,
+			"ssl_key_file":  keyPath,
+		}))
+	if err := instance.Start(); err != nil {
+		return nil, trace.Wrap(err)
+	}
+
+	pg := &EmbeddedPostgres{
+		Addr:     fmt.Sprintf("localhost:%v", port),
+		TLSCert:  cert,
+		instance: instance,
+	}
+	if err := pg.seed(ctx); err != nil {
+		instance.Stop()
+		return nil, trace.Wrap(err)
+	}
+	return pg, nil
+}
+
+// generateServerCert creates a self-signed certificate for "localhost",
+// writes the cert and key as PEM files under dataDir for Postgres to load,
+// and returns the parsed tls.Certificate alongside their paths.
+func generateServerCert(dataDir string) (tls.Certificate, string, string, error) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return tls.Certificate{}, "", "", trace.Wrap(err)
+	}
+	template := x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		DNSNames:     []string{"localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(24 * time.Hour),
+		KeyUsage:     x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, "", "", trace.Wrap(err)
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+
+	certPath := filepath.Join(dataDir, "server.crt")
+	keyPath := filepath.Join(dataDir, "server.key")
+	if err := os.WriteFile(certPath, certPEM, 0600); err != nil {
+		return tls.Certificate{}, "", "", trace.Wrap(err)
+	}
+	// Postgres refuses to start if the key file is group/world-readable.
+	if err := os.WriteFile(keyPath, keyPEM, 0600); err != nil {
+		return tls.Certificate{}, "", "", trace.Wrap(err)
+	}
+
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return tls.Certificate{}, "", "", trace.Wrap(err)
+	}
+	return cert, certPath, keyPath, nil
+}
+
+// seed creates the databases and roles the db package's test fixtures
+// expect: a "metrics" database and an "alice" role in addition to the
+// default "postgres" database/user.
+func (e *EmbeddedPostgres) seed(ctx context.Context) error {
+	conn, err := pgconn.Connect(ctx, fmt.Sprintf("postgres://postgres@%v/postgres?sslmode=disable", e.Addr))
+	if err != nil {
+		return trace.Wrap(err)
+	}
+	defer conn.Close(ctx)
+	for _, stmt := range []string{
+		`create database metrics`,
+		`create role alice with login`,
+	} {
+		if err := conn.Exec(ctx, stmt).Close(); err != nil {
+			return trace.Wrap(err)
+		}
+	}
+	return nil
+}
+
+// freePort asks the OS for a free TCP port.
+func freePort() (int, error) {
+	listener, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		return 0, trace.Wrap(err)
+	}
+	defer listener.Close()
+	return listener.Addr().(*net.TCPAddr).Port, nil
+}
@@ -0,0 +1,147 @@
+//go:build integration
+// +build integration
+
+/*
+Copyright 2020 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package db
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/gravitational/teleport/lib/auth"
+	"github.com/gravitational/teleport/lib/services"
+	"github.com/gravitational/teleport/lib/srv/db/dbtest"
+
+	"github.com/jackc/pgconn"
+	"github.com/stretchr/testify/require"
+)
+
+// setupEmbeddedPostgres boots a real Postgres via dbtest.NewEmbeddedPostgres,
+// seeding the "postgres" and "metrics" databases and the "alice" role used
+// by the test fixtures. Unlike setupPostgresServer's PostgresServer, queries
+// against this instance go through the real wire protocol end to end,
+// including the backend TLS handshake against the generated server cert.
+func setupEmbeddedPostgres(t *testing.T) *dbtest.EmbeddedPostgres {
+	pg, err := dbtest.NewEmbeddedPostgres(context.Background(), t.TempDir())
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, pg.Close())
+	})
+	return pg
+}
+
+// connectToEmbeddedPostgres starts the mux/proxy/database service goroutines
+// around a real embedded Postgres, grants "alice" unrestricted access, and
+// returns a client connection to it proxied through the real wire protocol
+// end to end. Callers are responsible for closing the returned connection;
+// testCtx is closed automatically via t.Cleanup.
+func connectToEmbeddedPostgres(ctx context.Context, t *testing.T) *pgconn.PgConn {
+	pg := setupEmbeddedPostgres(t)
+	testCtx := setupTestContext(ctx, t, withEmbeddedPostgres(pg))
+	t.Cleanup(func() {
+		require.NoError(t, testCtx.Close())
+	})
+
+	go testCtx.mux.Serve()
+	go testCtx.proxyServer.Serve(testCtx.mux.DB())
+	go func() {
+		for conn := range testCtx.proxyConn {
+			testCtx.server.HandleConnection(conn)
+		}
+	}()
+
+	_, role, err := auth.CreateUserAndRole(testCtx.tlsServer.Auth(), "alice", []string{"admin"})
+	require.NoError(t, err)
+	role.SetDatabaseNames(services.Allow, []string{services.Wildcard})
+	role.SetDatabaseUsers(services.Allow, []string{services.Wildcard})
+	require.NoError(t, testCtx.tlsServer.Auth().UpsertRole(ctx, role))
+
+	pgConn, err := connectToPostgres(ctx, testCtx, connectConfig{service: "test", user: "alice", dbName: "postgres", dbUser: "alice"})
+	require.NoError(t, err)
+	return pgConn
+}
+
+// TestDatabaseAccessTransaction verifies that a multi-statement transaction
+// proxied through the real wire protocol commits as expected.
+func TestDatabaseAccessTransaction(t *testing.T) {
+	ctx := context.Background()
+	pgConn := connectToEmbeddedPostgres(ctx, t)
+	defer pgConn.Close(ctx)
+
+	require.NoError(t, pgConn.Exec(ctx, "begin").Close())
+	require.NoError(t, pgConn.Exec(ctx, "create table if not exists widgets (id int)").Close())
+	require.NoError(t, pgConn.Exec(ctx, "insert into widgets (id) values (1)").Close())
+	require.NoError(t, pgConn.Exec(ctx, "commit").Close())
+
+	result, err := pgConn.Exec(ctx, "select count(*) from widgets").ReadAll()
+	require.NoError(t, err)
+	require.Len(t, result, 1)
+}
+
+// TestDatabaseAccessFailingQuery verifies that an error from the backend
+// propagates back through the proxy to the client unchanged.
+func TestDatabaseAccessFailingQuery(t *testing.T) {
+	ctx := context.Background()
+	pgConn := connectToEmbeddedPostgres(ctx, t)
+	defer pgConn.Close(ctx)
+
+	_, err := pgConn.Exec(ctx, "select * from no_such_table").ReadAll()
+	require.Error(t, err)
+}
+
+// TestDatabaseAccessPreparedStatement verifies that an extended-protocol
+// prepared statement proxied through the real wire protocol round-trips
+// correctly, exercising a path the fake PostgresServer can't.
+func TestDatabaseAccessPreparedStatement(t *testing.T) {
+	ctx := context.Background()
+	pgConn := connectToEmbeddedPostgres(ctx, t)
+	defer pgConn.Close(ctx)
+
+	stmt, err := pgConn.Prepare(ctx, "", "select $1::int + 1", nil)
+	require.NoError(t, err)
+	result := pgConn.ExecPrepared(ctx, stmt.Name, [][]byte{[]byte("41")}, nil, nil)
+	_, err = result.ReadAll()
+	require.NoError(t, err)
+}
+
+// TestDatabaseAccessCopy verifies that the Postgres COPY protocol, which
+// switches the connection into a distinct streaming sub-protocol rather
+// than a single query/response round trip, proxies correctly end to end.
+//
+// LISTEN/NOTIFY and RDS IAM auth token substitution, also named in the
+// request that added this file as targets for real-wire-protocol coverage,
+// aren't exercised here: both depend on behavior inside postgres.Engine
+// (out-of-band server-to-client messages for the former, password
+// rewriting for the latter), which isn't part of this checkout, so there's
+// no production code path here to drive them through.
+func TestDatabaseAccessCopy(t *testing.T) {
+	ctx := context.Background()
+	pgConn := connectToEmbeddedPostgres(ctx, t)
+	defer pgConn.Close(ctx)
+
+	require.NoError(t, pgConn.Exec(ctx, "create table if not exists copy_target (id int)").Close())
+
+	tag, err := pgConn.CopyFrom(ctx, strings.NewReader("1\n2\n3\n"), "copy copy_target (id) from stdin")
+	require.NoError(t, err)
+	require.EqualValues(t, 3, tag.RowsAffected())
+
+	result, err := pgConn.Exec(ctx, "select count(*) from copy_target").ReadAll()
+	require.NoError(t, err)
+	require.Len(t, result, 1)
+}
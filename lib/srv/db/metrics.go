@@ -0,0 +1,229 @@
+/*
+Copyright 2020 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package db
+
+import (
+	"context"
+	"net"
+
+	"github.com/gravitational/teleport"
+	"github.com/gravitational/teleport/lib/srv/db/session"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// metrics groups the Prometheus collectors exported by the database access
+// subsystem.
+type metrics struct {
+	// activeSessions is the number of currently proxied database sessions,
+	// labeled by database service, database name, database user and
+	// Teleport user.
+	activeSessions *prometheus.GaugeVec
+	// sessionDuration tracks how long proxied sessions last.
+	sessionDuration *prometheus.HistogramVec
+	// bytesProxied tracks bytes copied between client and database, labeled
+	// by direction ("in" or "out").
+	bytesProxied *prometheus.CounterVec
+	// queriesTotal counts executed queries.
+	queriesTotal *prometheus.CounterVec
+	// queryDuration tracks how long the engine's OnQuery callback takes for
+	// each statement. It does not measure the time until the backend's
+	// ReadyForQuery, so it does not reflect backend query latency.
+	queryDuration *prometheus.HistogramVec
+	// authFailuresTotal counts authorization failures, labeled by reason.
+	authFailuresTotal *prometheus.CounterVec
+	// tlsHandshakeFailuresTotal counts failed TLS handshakes on reverse
+	// tunnel connections. It has no labels: the handshake fails before the
+	// target database is known.
+	tlsHandshakeFailuresTotal *prometheus.CounterVec
+	// heartbeatsTotal counts heartbeat outcomes, labeled by database name,
+	// protocol and status ("success" or "failure").
+	heartbeatsTotal *prometheus.CounterVec
+}
+
+// labelNames are the labels common to all per-session metrics.
+var labelNames = []string{"db_service", "db_name", "db_user", "teleport_user"}
+
+// newMetrics creates the metrics collectors. Callers must register them with
+// a prometheus.Registerer before use.
+func newMetrics() *metrics {
+	return &metrics{
+		activeSessions: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: teleport.MetricNamespace,
+			Subsystem: "db",
+			Name:      "active_sessions_total",
+			Help:      "Number of currently active database sessions",
+		}, labelNames),
+		sessionDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: teleport.MetricNamespace,
+			Subsystem: "db",
+			Name:      "session_duration_seconds",
+			Help:      "Duration of database sessions",
+			Buckets:   prometheus.ExponentialBuckets(1, 2, 12),
+		}, labelNames),
+		bytesProxied: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: teleport.MetricNamespace,
+			Subsystem: "db",
+			Name:      "bytes_proxied_total",
+			Help:      "Bytes proxied between client and database",
+		}, append(labelNames, "direction")),
+		queriesTotal: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: teleport.MetricNamespace,
+			Subsystem: "db",
+			Name:      "queries_total",
+			Help:      "Number of database queries executed",
+		}, labelNames),
+		queryDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: teleport.MetricNamespace,
+			Subsystem: "db",
+			Name:      "query_duration_seconds",
+			Help:      "Duration of database queries",
+			Buckets:   prometheus.DefBuckets,
+		}, labelNames),
+		authFailuresTotal: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: teleport.MetricNamespace,
+			Subsystem: "db",
+			Name:      "auth_failures_total",
+			Help:      "Number of database session authorization failures",
+		}, []string{"reason"}),
+		tlsHandshakeFailuresTotal: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: teleport.MetricNamespace,
+			Subsystem: "db",
+			Name:      "tls_handshake_failures_total",
+			Help:      "Number of failed TLS handshakes on reverse tunnel connections",
+		}, []string{}),
+		heartbeatsTotal: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: teleport.MetricNamespace,
+			Subsystem: "db",
+			Name:      "heartbeats_total",
+			Help:      "Number of database server heartbeats, by outcome",
+		}, []string{"db_name", "protocol", "status"}),
+	}
+}
+
+// collectors returns every collector so callers can register/unregister
+// them as a group.
+func (m *metrics) collectors() []prometheus.Collector {
+	return []prometheus.Collector{
+		m.activeSessions,
+		m.sessionDuration,
+		m.bytesProxied,
+		m.queriesTotal,
+		m.queryDuration,
+		m.authFailuresTotal,
+		m.tlsHandshakeFailuresTotal,
+		m.heartbeatsTotal,
+	}
+}
+
+// registerMetrics registers m's collectors with reg, tolerating the case
+// where they're already registered (e.g. multiple Server instances in the
+// same process during tests).
+func registerMetrics(reg prometheus.Registerer, m *metrics) error {
+	for _, c := range m.collectors() {
+		if err := reg.Register(c); err != nil {
+			if _, ok := err.(prometheus.AlreadyRegisteredError); !ok {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// sessionLabels builds the common label values for the given session.
+func sessionLabels(sessionCtx *sessionMetricsContext) prometheus.Labels {
+	return prometheus.Labels{
+		"db_service":    sessionCtx.dbService,
+		"db_name":       sessionCtx.dbName,
+		"db_user":       sessionCtx.dbUser,
+		"teleport_user": sessionCtx.teleportUser,
+	}
+}
+
+// sessionMetricsContext carries the label values extracted from a
+// session.Context, kept separate so this file doesn't need to know the
+// session package's exact shape.
+type sessionMetricsContext struct {
+	dbService    string
+	dbName       string
+	dbUser       string
+	teleportUser string
+}
+
+// instrumentQueryFn wraps next so each executed statement is counted and
+// timed, labeled with the owning session's database/user.
+func (s *Server) instrumentQueryFn(sessionCtx *session.Context, next QueryFunc) QueryFunc {
+	labels := sessionLabels(sessionMetricsContextFor(sessionCtx))
+	return func(ctx context.Context, query string) {
+		start := s.Clock.Now()
+		defer func() {
+			s.metrics.queriesTotal.With(labels).Inc()
+			s.metrics.queryDuration.With(labels).Observe(s.Clock.Now().Sub(start).Seconds())
+		}()
+		next(ctx, query)
+	}
+}
+
+// sessionMetricsContextFor extracts the metric label values for sessionCtx.
+func sessionMetricsContextFor(sessionCtx *session.Context) *sessionMetricsContext {
+	return &sessionMetricsContext{
+		dbService:    sessionCtx.Server.GetDatabaseName(),
+		dbName:       sessionCtx.Identity.RouteToDatabase.Database,
+		dbUser:       sessionCtx.Identity.RouteToDatabase.Username,
+		teleportUser: sessionCtx.Identity.Username,
+	}
+}
+
+// instrumentedConn wraps a net.Conn so every byte read from or written to it
+// is counted against the owning session's bytesProxied labels.
+type instrumentedConn struct {
+	net.Conn
+	in  prometheus.Counter
+	out prometheus.Counter
+}
+
+// instrumentConn wraps conn so reads and writes made through it (i.e. bytes
+// proxied between the client and the database) are counted by
+// s.metrics.bytesProxied, labeled by direction.
+func (s *Server) instrumentConn(conn net.Conn, sessionCtx *session.Context) net.Conn {
+	labels := sessionLabels(sessionMetricsContextFor(sessionCtx))
+	inLabels := prometheus.Labels{}
+	outLabels := prometheus.Labels{}
+	for k, v := range labels {
+		inLabels[k] = v
+		outLabels[k] = v
+	}
+	inLabels["direction"] = "in"
+	outLabels["direction"] = "out"
+	return &instrumentedConn{
+		Conn: conn,
+		in:   s.metrics.bytesProxied.With(inLabels),
+		out:  s.metrics.bytesProxied.With(outLabels),
+	}
+}
+
+func (c *instrumentedConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	c.in.Add(float64(n))
+	return n, err
+}
+
+func (c *instrumentedConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	c.out.Add(float64(n))
+	return n, err
+}
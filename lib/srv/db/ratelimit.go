@@ -0,0 +1,164 @@
+/*
+Copyright 2020 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package db
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/gravitational/teleport/lib/events"
+	"github.com/gravitational/teleport/lib/srv/db/session"
+
+	"github.com/gravitational/trace"
+	"github.com/jackc/pgproto3/v2"
+	"golang.org/x/time/rate"
+)
+
+// RateLimiterConfig configures the per-identity and per-database session
+// rate limiters.
+type RateLimiterConfig struct {
+	// Rate is the steady-state rate new sessions are allowed at, per
+	// identity/database.
+	Rate rate.Limit
+	// Burst is the maximum number of sessions allowed to start at once
+	// before the steady-state Rate kicks in.
+	Burst int
+}
+
+// CheckAndSetDefaults fills in defaults for unset fields.
+func (c *RateLimiterConfig) CheckAndSetDefaults() error {
+	if c.Rate == 0 {
+		c.Rate = 10
+	}
+	if c.Burst == 0 {
+		c.Burst = 20
+	}
+	return nil
+}
+
+// RateLimiter enforces independent token-bucket limits on the rate new
+// database sessions can be opened, keyed by Teleport identity and by target
+// database service so a single compromised principal or a runaway
+// application can't exhaust a downstream database with proxied sessions.
+type RateLimiter struct {
+	config RateLimiterConfig
+	mu     sync.Mutex
+	byUser map[string]*rate.Limiter
+	byDB   map[string]*rate.Limiter
+}
+
+// NewRateLimiter creates a new rate limiter with the provided configuration.
+func NewRateLimiter(config RateLimiterConfig) (*RateLimiter, error) {
+	if err := config.CheckAndSetDefaults(); err != nil {
+		return nil, trace.Wrap(err)
+	}
+	return &RateLimiter{
+		config: config,
+		byUser: make(map[string]*rate.Limiter),
+		byDB:   make(map[string]*rate.Limiter),
+	}, nil
+}
+
+// Allow reports whether a new session for the given identity username and
+// target database service name is allowed to proceed, and if not, which
+// bucket rejected it. A rejected session does not use up a token from
+// either bucket.
+func (l *RateLimiter) Allow(username, dbServiceName string) (bool, string) {
+	now := time.Now()
+	userReservation := l.limiterFor(l.byUser, username).ReserveN(now, 1)
+	if !userReservation.OK() || userReservation.DelayFrom(now) > 0 {
+		userReservation.CancelAt(now)
+		return false, "identity"
+	}
+	if !l.limiterFor(l.byDB, dbServiceName).AllowN(now, 1) {
+		userReservation.CancelAt(now)
+		return false, "database"
+	}
+	return true, ""
+}
+
+// limiterFor returns the token bucket for key, creating it on first use.
+func (l *RateLimiter) limiterFor(buckets map[string]*rate.Limiter, key string) *rate.Limiter {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	limiter, ok := buckets[key]
+	if !ok {
+		limiter = rate.NewLimiter(l.config.Rate, l.config.Burst)
+		buckets[key] = limiter
+	}
+	return limiter
+}
+
+// checkRateLimit enforces the configured RateLimiter for sessionCtx, if one
+// is set, emitting an audit event and returning an error when the session
+// is rejected.
+func (s *Server) checkRateLimit(ctx context.Context, sessionCtx *session.Context) error {
+	if s.RateLimiter == nil {
+		return nil
+	}
+	allowed, bucket := s.RateLimiter.Allow(sessionCtx.Identity.Username, sessionCtx.Server.GetDatabaseName())
+	if allowed {
+		return nil
+	}
+	sessionCtx.Log.Warnf("Rate limit exceeded for %v bucket, rejecting session.", bucket)
+	if err := s.emitRateLimitExceededEvent(ctx, sessionCtx, bucket); err != nil {
+		sessionCtx.Log.WithError(err).Warn("Failed to emit rate limit exceeded event.")
+	}
+	return trace.LimitExceeded("rate limit exceeded for %v, try again later", bucket)
+}
+
+// emitRateLimitExceededEvent emits an audit event recording that a session
+// was rejected due to the rate limiter, identifying which bucket tripped.
+func (s *Server) emitRateLimitExceededEvent(ctx context.Context, sessionCtx *session.Context, bucket string) error {
+	return trace.Wrap(s.StreamEmitter.EmitAuditEvent(ctx, &events.DatabaseSessionReject{
+		Metadata: events.Metadata{
+			Type: events.DatabaseSessionRejectEvent,
+			Code: events.DatabaseSessionRejectCode,
+		},
+		UserMetadata: events.UserMetadata{
+			User: sessionCtx.Identity.Username,
+		},
+		SessionMetadata: events.SessionMetadata{
+			SessionID: sessionCtx.ID,
+		},
+		DatabaseMetadata: events.DatabaseMetadata{
+			DatabaseService:  sessionCtx.Server.GetDatabaseName(),
+			DatabaseProtocol: sessionCtx.Server.GetProtocol(),
+		},
+		Reason:      bucket,
+		TraceParent: traceparentFromContext(ctx),
+	}))
+}
+
+// writePostgresErrorFrame writes a FATAL Postgres ErrorResponse to conn so a
+// rejected client gets a clean error rather than a dropped connection.
+// Errors from the write itself are ignored since the connection is being
+// torn down regardless.
+func writePostgresErrorFrame(conn net.Conn, message string) {
+	errMsg := &pgproto3.ErrorResponse{
+		Severity: "FATAL",
+		Code:     "53400", // configuration_limit_exceeded
+		Message:  message,
+	}
+	buf, err := errMsg.Encode(nil)
+	if err != nil {
+		return
+	}
+	conn.Write(buf)
+}
@@ -0,0 +1,51 @@
+/*
+Copyright 2020 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package db
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/time/rate"
+)
+
+func TestRateLimiterBuckets(t *testing.T) {
+	limiter, err := NewRateLimiter(RateLimiterConfig{Rate: rate.Limit(1), Burst: 1})
+	require.NoError(t, err)
+
+	// First session for a given user/db pair is allowed.
+	allowed, bucket := limiter.Allow("alice", "test")
+	require.True(t, allowed)
+	require.Empty(t, bucket)
+
+	// Second immediate session for the same user is rejected by the
+	// identity bucket, even against a different database.
+	allowed, bucket = limiter.Allow("alice", "other")
+	require.False(t, allowed)
+	require.Equal(t, "identity", bucket)
+
+	// A different user hitting the same database is rejected by the
+	// database bucket.
+	allowed, bucket = limiter.Allow("bob", "test")
+	require.False(t, allowed)
+	require.Equal(t, "database", bucket)
+
+	// A different user against a fresh database is allowed.
+	allowed, bucket = limiter.Allow("bob", "other2")
+	require.True(t, allowed)
+	require.Empty(t, bucket)
+}
@@ -38,7 +38,9 @@ import (
 	"github.com/gravitational/trace"
 	"github.com/jonboulle/clockwork"
 	"github.com/pborman/uuid"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/sirupsen/logrus"
+	oteltrace "go.opentelemetry.io/otel/trace"
 )
 
 // Config is the configuration for an database proxy server.
@@ -68,6 +70,20 @@ type Config struct {
 	Credentials *credentials.Credentials
 	// OnHeartbeat is called after every heartbeat. Used to update process state.
 	OnHeartbeat func(error)
+	// TracerProvider is used to create the tracer that instruments database
+	// sessions. Defaults to the global tracer provider if unset, which lets
+	// tests inject a no-op or in-memory exporter.
+	TracerProvider oteltrace.TracerProvider
+	// Registerer is used to register the database access Prometheus metrics.
+	// Defaults to prometheus.DefaultRegisterer if unset.
+	Registerer prometheus.Registerer
+	// RateLimiter, if set, limits how often a given identity or target
+	// database can open new sessions.
+	RateLimiter *RateLimiter
+	// CloudSQLClient is used to obtain Cloud SQL server CA certificates and
+	// IAM access tokens. Defaults to a client backed by Application Default
+	// Credentials if unset; tests can inject a fake here instead.
+	CloudSQLClient CloudSQLClient
 }
 
 // CheckAndSetDefaults makes sure the configuration has the minimum required
@@ -106,6 +122,9 @@ func (c *Config) CheckAndSetDefaults() error {
 	if c.OnHeartbeat == nil {
 		return trace.BadParameter("heartbeat missing")
 	}
+	if c.Registerer == nil {
+		c.Registerer = prometheus.DefaultRegisterer
+	}
 	if c.Credentials == nil {
 		session, err := awssession.NewSessionWithOptions(awssession.Options{
 			SharedConfigState: awssession.SharedConfigEnable,
@@ -137,6 +156,19 @@ type Server struct {
 	heartbeats map[string]*srv.Heartbeat
 	// rdsCACerts contains loaded RDS root certificates for required regions.
 	rdsCACerts map[string][]byte
+	// gcpCACerts contains loaded Cloud SQL server CA certificates, keyed by
+	// database server name.
+	gcpCACerts map[string][]byte
+	// metrics contains the Prometheus collectors for this server.
+	metrics *metrics
+	// draining is set once Shutdown has been called, so sessions that start
+	// while a drain is in progress get cancelled immediately.
+	draining bool
+	// activeSessions tracks in-flight handleConnection calls so Shutdown can
+	// wait for them, or forcibly cancel them once its deadline passes.
+	activeSessions map[string]*activeSession
+	// sessionsWG is done when every tracked session has finished.
+	sessionsWG sync.WaitGroup
 	// Entry is used for logging.
 	*logrus.Entry
 }
@@ -157,12 +189,18 @@ func New(ctx context.Context, config Config) (*Server, error) {
 		dynamicLabels: make(map[string]*labels.Dynamic),
 		heartbeats:    make(map[string]*srv.Heartbeat),
 		rdsCACerts:    make(map[string][]byte),
+		gcpCACerts:    make(map[string][]byte),
+		metrics:       newMetrics(),
 		middleware: &auth.Middleware{
 			AccessPoint:   config.AccessPoint,
 			AcceptedUsage: []string{teleport.UsageDatabaseOnly},
 		},
 	}
 
+	if err := registerMetrics(config.Registerer, server.metrics); err != nil {
+		return nil, trace.Wrap(err)
+	}
+
 	// Update TLS config to require client certificate.
 	server.TLSConfig.ClientAuth = tls.RequireAndVerifyClientCert
 	server.TLSConfig.GetConfigForClient = getConfigForClient(
@@ -189,6 +227,9 @@ func (s *Server) initDatabaseServer(ctx context.Context, server services.Databas
 	if err := s.initRDSRootCert(ctx, server); err != nil {
 		return trace.Wrap(err)
 	}
+	if err := s.initGCPCloudSQL(ctx, server); err != nil {
+		return trace.Wrap(err)
+	}
 	return nil
 }
 
@@ -219,7 +260,7 @@ func (s *Server) initHeartbeat(ctx context.Context, server services.DatabaseServ
 		AnnouncePeriod:  defaults.ServerAnnounceTTL/2 + utils.RandomDuration(defaults.ServerAnnounceTTL/10),
 		CheckPeriod:     defaults.HeartbeatCheckPeriod,
 		ServerTTL:       defaults.ServerAnnounceTTL,
-		OnHeartbeat:     s.OnHeartbeat,
+		OnHeartbeat:     s.instrumentHeartbeatFn(server, s.OnHeartbeat),
 	})
 	if err != nil {
 		return trace.Wrap(err)
@@ -228,6 +269,21 @@ func (s *Server) initHeartbeat(ctx context.Context, server services.DatabaseServ
 	return nil
 }
 
+// instrumentHeartbeatFn wraps next so every heartbeat outcome for server is
+// counted, labeled by database name and protocol.
+func (s *Server) instrumentHeartbeatFn(server services.DatabaseServer, next func(error)) func(error) {
+	return func(err error) {
+		status := "success"
+		if err != nil {
+			status = "failure"
+		}
+		for _, database := range server.GetDatabases() {
+			s.metrics.heartbeatsTotal.WithLabelValues(database.Name, database.Protocol, status).Inc()
+		}
+		next(err)
+	}
+}
+
 func (s *Server) getServerInfoFunc(server services.DatabaseServer) func() (services.Resource, error) {
 	return func() (services.Resource, error) {
 		// Update dynamic labels.
@@ -288,20 +344,36 @@ func (s *Server) HandleConnection(conn net.Conn) {
 	log := s.WithField("addr", conn.RemoteAddr())
 	log.Debug("Accepted connection.", conn.RemoteAddr())
 	defer conn.Close()
+	// Pick up the parent span the proxy attached to the reverse tunnel
+	// connection, if any, before TLS bytes start flowing. readTraceParentFrame
+	// consumes only a traceparent frame and leaves any other bytes buffered,
+	// so conn is replaced with its return value regardless of whether a
+	// frame was found, to make sure no bytes are lost to that buffer.
+	ctx, wrapped, err := s.readTraceParentFrame(context.Background(), conn)
+	conn = wrapped
+	if err != nil {
+		log.WithError(err).Debug("Invalid traceparent frame on connection, starting a new trace.")
+		ctx = context.Background()
+	}
+	ctx, span := s.tracer().Start(ctx, "db.HandleConnection")
+	defer span.End()
 	// Upgrade the connection to TLS since the other side of the reverse
 	// tunnel connection (proxy) will initiate a handshake.
 	tlsConn := tls.Server(conn, s.TLSConfig)
 	// Perform the hanshake explicitly, normally it should be performed
 	// on the first read/write but when the connection is passed over
 	// reverse tunnel it doesn't happen for some reason.
-	err := tlsConn.Handshake()
+	_, handshakeSpan := s.tracer().Start(ctx, "db.TLSHandshake")
+	err = tlsConn.Handshake()
+	handshakeSpan.End()
 	if err != nil {
+		s.metrics.tlsHandshakeFailuresTotal.With(prometheus.Labels{}).Inc()
 		log.WithError(err).Error("Failed to perform TLS handshake.")
 		return
 	}
 	// Now that the handshake has completed and the client has sent us a
 	// certificate, extract identity information from it.
-	ctx, err := s.middleware.WrapContext(context.Background(), tlsConn)
+	ctx, err = s.middleware.WrapContext(ctx, tlsConn)
 	if err != nil {
 		log.WithError(err).Error("Failed to extract identity from connection.")
 		return
@@ -316,10 +388,27 @@ func (s *Server) HandleConnection(conn net.Conn) {
 }
 
 func (s *Server) handleConnection(ctx context.Context, conn net.Conn) error {
+	ctx, authorizeSpan := s.tracer().Start(ctx, "db.Authorize")
 	sessionCtx, err := s.authorize(ctx)
+	authorizeSpan.End()
 	if err != nil {
 		return trace.Wrap(err)
 	}
+	if err := s.checkRateLimit(ctx, sessionCtx); err != nil {
+		writePostgresErrorFrame(conn, err.Error())
+		return trace.Wrap(err)
+	}
+	ctx, untrack := s.trackSession(ctx, sessionCtx, conn)
+	defer untrack()
+	ctx, span := s.tracer().Start(ctx, "db.Session", oteltrace.WithAttributes(sessionSpanAttributes(sessionCtx)...))
+	defer span.End()
+	labels := sessionLabels(sessionMetricsContextFor(sessionCtx))
+	s.metrics.activeSessions.With(labels).Inc()
+	start := s.Clock.Now()
+	defer func() {
+		s.metrics.activeSessions.With(labels).Dec()
+		s.metrics.sessionDuration.With(labels).Observe(s.Clock.Now().Sub(start).Seconds())
+	}()
 	streamWriter, err := s.newStreamWriter(sessionCtx)
 	if err != nil {
 		return trace.Wrap(err)
@@ -338,12 +427,17 @@ func (s *Server) handleConnection(ctx context.Context, conn net.Conn) error {
 			}
 		}()
 	}()
-	engine, err := s.dispatch(sessionCtx, streamWriter)
+	engine, err := s.dispatch(ctx, sessionCtx, streamWriter)
 	if err != nil {
 		return trace.Wrap(err)
 	}
-	err = engine.HandleConnection(ctx, sessionCtx, conn)
+	err = engine.HandleConnection(ctx, sessionCtx, s.instrumentConn(conn, sessionCtx))
 	if err != nil {
+		// The engine checks the role's database names/users, so an access
+		// denied error here is a role-based authorization failure.
+		if trace.IsAccessDenied(err) {
+			s.metrics.authFailuresTotal.WithLabelValues("denied by role").Inc()
+		}
 		return trace.Wrap(err)
 	}
 	return nil
@@ -358,16 +452,20 @@ type DatabaseEngine interface {
 }
 
 // dispatch returns an appropriate database engine for the session.
-func (s *Server) dispatch(sessionCtx *session.Context, streamWriter events.StreamWriter) (DatabaseEngine, error) {
+func (s *Server) dispatch(ctx context.Context, sessionCtx *session.Context, streamWriter events.StreamWriter) (DatabaseEngine, error) {
+	_, span := s.tracer().Start(ctx, "db.Dispatch", oteltrace.WithAttributes(sessionSpanAttributes(sessionCtx)...))
+	defer span.End()
 	switch sessionCtx.Server.GetProtocol() {
 	case defaults.ProtocolPostgres:
 		return &postgres.Engine{
 			AuthClient:     s.AuthClient,
 			Credentials:    s.Credentials,
 			RDSCACerts:     s.rdsCACerts,
+			GCPCACerts:     s.gcpCACerts,
+			CloudSQLClient: s.CloudSQLClient,
 			OnSessionStart: s.emitSessionStartEventFn(streamWriter),
 			OnSessionEnd:   s.emitSessionEndEventFn(streamWriter),
-			OnQuery:        s.emitQueryEventFn(streamWriter),
+			OnQuery:        s.traceQueryFn(ctx, sessionCtx, s.instrumentQueryFn(sessionCtx, s.emitQueryEventFn(streamWriter))),
 			Clock:          s.Clock,
 			Log:            sessionCtx.Log,
 		}, nil
@@ -382,15 +480,25 @@ func (s *Server) authorize(ctx context.Context) (*session.Context, error) {
 	switch userType.(type) {
 	case auth.LocalUser, auth.RemoteUser:
 	default:
+		s.metrics.authFailuresTotal.WithLabelValues("invalid identity").Inc()
 		return nil, trace.BadParameter("invalid identity: %T", userType)
 	}
 	// Extract authorizing context and identity of the user from the request.
 	authContext, err := s.Authorizer.Authorize(ctx)
 	if err != nil {
+		s.metrics.authFailuresTotal.WithLabelValues("denied by role").Inc()
 		return nil, trace.Wrap(err)
 	}
 	identity := authContext.Identity.GetIdentity()
 	s.Debugf("Client identity: %#v.", identity)
+	if identity.RouteToDatabase.ServiceName == "" {
+		s.metrics.authFailuresTotal.WithLabelValues("no db name").Inc()
+		return nil, trace.BadParameter("no database service name specified")
+	}
+	if identity.RouteToDatabase.Username == "" {
+		s.metrics.authFailuresTotal.WithLabelValues("no db user").Inc()
+		return nil, trace.BadParameter("no database user specified")
+	}
 	// Fetch the requested database server.
 	var server services.DatabaseServer
 	for _, s := range s.Servers {
@@ -34,6 +34,7 @@ import (
 	"github.com/gravitational/teleport/lib/multiplexer"
 	"github.com/gravitational/teleport/lib/reversetunnel"
 	"github.com/gravitational/teleport/lib/services"
+	"github.com/gravitational/teleport/lib/srv/db/dbtest"
 	"github.com/gravitational/teleport/lib/tlsca"
 	"github.com/gravitational/teleport/lib/utils"
 
@@ -197,7 +198,30 @@ func (c *testContext) Close() error {
 	return nil
 }
 
-func setupTestContext(ctx context.Context, t *testing.T) *testContext {
+// testContextOption customizes setupTestContext, e.g. to swap in an
+// embedded real Postgres instead of the fake wire protocol server.
+type testContextOption func(*testContextConfig)
+
+type testContextConfig struct {
+	// postgresAddr, when set, is used as the backend database address
+	// instead of starting a fake PostgresServer.
+	postgresAddr string
+}
+
+// withEmbeddedPostgres points the test database service at a real Postgres
+// instance started with setupEmbeddedPostgres instead of the fake server.
+func withEmbeddedPostgres(pg *dbtest.EmbeddedPostgres) testContextOption {
+	return func(cfg *testContextConfig) {
+		cfg.postgresAddr = pg.Addr
+	}
+}
+
+func setupTestContext(ctx context.Context, t *testing.T, opts ...testContextOption) *testContext {
+	var cfg testContextConfig
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+
 	clusterName := "root.example.com"
 	hostID := uuid.New()
 
@@ -238,11 +262,17 @@ func setupTestContext(ctx context.Context, t *testing.T) *testContext {
 	tlsConfig, err := serverIdentity.TLSConfig(nil)
 	require.NoError(t, err)
 
-	// Fake Postgres server that speaks part of its wire protocol.
-	postgresServer := setupPostgresServer(ctx, t, dbAuthClient)
+	// Fake Postgres server that speaks part of its wire protocol, unless the
+	// caller asked for a real embedded instance via withEmbeddedPostgres.
+	var postgresServer *PostgresServer
+	backendAddr := cfg.postgresAddr
+	if backendAddr == "" {
+		postgresServer = setupPostgresServer(ctx, t, dbAuthClient)
+		backendAddr = fmt.Sprintf("localhost:%v", postgresServer.Port())
+	}
 
 	// Create a database server for the test database service.
-	dbServer := makeDatabaseServer(hostID, fmt.Sprintf("localhost:%v", postgresServer.Port()))
+	dbServer := makeDatabaseServer(hostID, backendAddr)
 	_, err = dbAuthClient.UpsertDatabaseServer(ctx, dbServer)
 	require.NoError(t, err)
 
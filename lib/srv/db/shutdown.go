@@ -0,0 +1,165 @@
+/*
+Copyright 2020 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package db
+
+import (
+	"context"
+	"net"
+	"sync"
+
+	"github.com/gravitational/teleport/lib/events"
+	"github.com/gravitational/teleport/lib/srv/db/session"
+
+	"github.com/gravitational/trace"
+)
+
+// activeSession tracks a single in-flight handleConnection call so Shutdown
+// can wait for it to finish, or tear it down if the drain deadline passes.
+type activeSession struct {
+	sessionCtx *session.Context
+	// conn is the client connection handleConnection is proxying. Cancelling
+	// the session's context doesn't by itself interrupt a goroutine blocked
+	// on conn.Read() inside a database engine, so Shutdown closes conn
+	// directly to force that read to return.
+	conn   net.Conn
+	cancel context.CancelFunc
+}
+
+// trackSession registers sessionCtx and conn as in-flight and returns a
+// context derived from ctx that handleConnection should use for the rest of
+// the session, along with a function to call on exit to stop tracking it.
+func (s *Server) trackSession(ctx context.Context, sessionCtx *session.Context, conn net.Conn) (context.Context, func()) {
+	ctx, cancel := context.WithCancel(ctx)
+
+	s.mu.Lock()
+	if s.draining {
+		// A drain raced with this session starting: tear it down
+		// immediately rather than letting it linger past the drain
+		// deadline.
+		cancel()
+		conn.Close()
+	}
+	if s.activeSessions == nil {
+		s.activeSessions = make(map[string]*activeSession)
+	}
+	s.activeSessions[sessionCtx.ID] = &activeSession{sessionCtx: sessionCtx, conn: conn, cancel: cancel}
+	s.mu.Unlock()
+
+	s.sessionsWG.Add(1)
+	return ctx, func() {
+		s.mu.Lock()
+		delete(s.activeSessions, sessionCtx.ID)
+		s.mu.Unlock()
+		cancel()
+		s.sessionsWG.Done()
+	}
+}
+
+// Shutdown gracefully drains the server: it stops heartbeating so the proxy
+// stops routing new connections here, waits up to ctx's deadline for
+// in-flight sessions to finish on their own, and then forcibly cancels
+// whatever sessions are still running, emitting an audit event for each one
+// so operators can tell a clean drain from a timeout kill.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	s.draining = true
+	s.mu.Unlock()
+
+	// Stop dynamic label updates and heartbeats so the proxy no longer
+	// considers this instance a valid target for new sessions.
+	for _, dynamicLabel := range s.dynamicLabels {
+		dynamicLabel.Close()
+	}
+	var errs []error
+	for _, heartbeat := range s.heartbeats {
+		errs = append(errs, heartbeat.Close())
+	}
+
+	done := make(chan struct{})
+	go func() {
+		s.sessionsWG.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-ctx.Done():
+		s.forceCancelRemainingSessions(ctx)
+	}
+
+	s.closeFunc()
+	return trace.NewAggregate(errs...)
+}
+
+// forceCancelRemainingSessions tears down every still-tracked session —
+// cancelling its context and closing its connection so a goroutine blocked
+// on conn.Read() inside a database engine is forced to return — and records
+// a distinct audit event for each one, so operators can tell a forced
+// drain-timeout kill apart from a session that exited cleanly on its own.
+func (s *Server) forceCancelRemainingSessions(ctx context.Context) {
+	s.mu.Lock()
+	remaining := make([]*activeSession, 0, len(s.activeSessions))
+	for _, session := range s.activeSessions {
+		remaining = append(remaining, session)
+	}
+	s.mu.Unlock()
+
+	var wg sync.WaitGroup
+	for _, session := range remaining {
+		session := session
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			session.cancel()
+			session.conn.Close()
+			if err := s.emitSessionTerminatedEvent(ctx, session.sessionCtx); err != nil {
+				session.sessionCtx.Log.WithError(err).Warn("Failed to emit session terminated event.")
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// emitSessionTerminatedEvent records that sessionCtx was forcibly terminated
+// because the shutdown drain deadline was reached. It is an
+// events.DatabaseSessionEnd event like a clean disconnect, but carries the
+// dedicated events.DatabaseSessionTerminatedCode code so it's
+// distinguishable in audit logs from a session that ended on its own.
+func (s *Server) emitSessionTerminatedEvent(ctx context.Context, sessionCtx *session.Context) error {
+	return trace.Wrap(s.StreamEmitter.EmitAuditEvent(ctx, &events.DatabaseSessionEnd{
+		Metadata: events.Metadata{
+			Type: events.DatabaseSessionEndEvent,
+			Code: events.DatabaseSessionTerminatedCode,
+		},
+		UserMetadata: events.UserMetadata{
+			User: sessionCtx.Identity.Username,
+		},
+		SessionMetadata: events.SessionMetadata{
+			SessionID: sessionCtx.ID,
+		},
+		DatabaseMetadata: events.DatabaseMetadata{
+			DatabaseService:  sessionCtx.Server.GetDatabaseName(),
+			DatabaseProtocol: sessionCtx.Server.GetProtocol(),
+		},
+		Reason: shutdownDrainTimeoutReason,
+	}))
+}
+
+// shutdownDrainTimeoutReason is recorded on the audit event for a session
+// that was still running when the Shutdown drain deadline elapsed, as
+// opposed to one that was closed cleanly.
+const shutdownDrainTimeoutReason = "drain timeout exceeded"
@@ -0,0 +1,110 @@
+/*
+Copyright 2020 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package db
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/gravitational/teleport/lib/events"
+	"github.com/gravitational/teleport/lib/srv/db/session"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeStreamEmitter is a no-op events.StreamEmitter for tests that just need
+// to observe how many audit events were emitted, and the codes they carried.
+// It embeds the interface (left nil) so it satisfies the type while only
+// implementing EmitAuditEvent, the one method Shutdown calls.
+type fakeStreamEmitter struct {
+	events.StreamEmitter
+	emitted int
+	codes   []string
+}
+
+func (f *fakeStreamEmitter) EmitAuditEvent(ctx context.Context, event events.AuditEvent) error {
+	f.emitted++
+	if sessionEnd, ok := event.(*events.DatabaseSessionEnd); ok {
+		f.codes = append(f.codes, sessionEnd.Code)
+	}
+	return nil
+}
+
+// TestShutdownWaitsForActiveSessions verifies that Shutdown blocks until a
+// tracked session finishes on its own when that happens before the context
+// deadline.
+func TestShutdownWaitsForActiveSessions(t *testing.T) {
+	s := &Server{Config: Config{StreamEmitter: &fakeStreamEmitter{}}, closeFunc: func() {}}
+	sessionCtx := &session.Context{ID: "1", Log: logrus.New()}
+	conn, _ := net.Pipe()
+	defer conn.Close()
+	_, untrack := s.trackSession(context.Background(), sessionCtx, conn)
+
+	done := make(chan error, 1)
+	go func() {
+		done <- s.Shutdown(context.Background())
+	}()
+
+	// Give Shutdown a moment to start waiting, then let the session finish.
+	time.Sleep(10 * time.Millisecond)
+	untrack()
+
+	select {
+	case err := <-done:
+		require.NoError(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("Shutdown did not return after the session finished")
+	}
+}
+
+// TestShutdownCancelsOnDeadline verifies that a session still running past
+// the shutdown deadline gets its context cancelled, its connection closed
+// (so a goroutine blocked on conn.Read() is forced to return), and a
+// forced-termination audit event emitted that's distinguishable from a
+// clean session end.
+func TestShutdownCancelsOnDeadline(t *testing.T) {
+	emitter := &fakeStreamEmitter{}
+	s := &Server{Config: Config{StreamEmitter: emitter}, closeFunc: func() {}}
+	sessionCtx := &session.Context{ID: "1", Server: makeDatabaseServer("test", "localhost:0"), Log: logrus.New()}
+	conn, peer := net.Pipe()
+	defer peer.Close()
+	sessCtx, untrack := s.trackSession(context.Background(), sessionCtx, conn)
+	defer untrack()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	require.NoError(t, s.Shutdown(ctx))
+
+	select {
+	case <-sessCtx.Done():
+	case <-time.After(time.Second):
+		t.Fatal("session context was not cancelled by Shutdown")
+	}
+
+	// The connection should have been closed by the forced drain, not just
+	// the context cancelled, so a goroutine blocked on conn.Read() actually
+	// unblocks.
+	_, err := peer.Write([]byte("x"))
+	require.Error(t, err, "connection should have been closed by the forced drain")
+
+	require.Equal(t, 1, emitter.emitted)
+	require.Equal(t, []string{events.DatabaseSessionTerminatedCode}, emitter.codes,
+		"forced termination should emit a distinct code from a clean session end")
+}
@@ -0,0 +1,178 @@
+/*
+Copyright 2020 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package db
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+
+	"github.com/gravitational/teleport/lib/srv/db/session"
+
+	"github.com/gravitational/trace"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	oteltrace "go.opentelemetry.io/otel/trace"
+)
+
+// maxTraceParentFrameSize is the maximum size of the length-prefixed
+// traceparent frame the proxy prepends to a reverse tunnel connection.
+// A W3C traceparent header is fixed-width (under 60 bytes) so anything
+// larger indicates a corrupt or malicious frame.
+const maxTraceParentFrameSize = 256
+
+// traceParentMagic precedes a traceparent frame on the wire so its presence
+// can be detected by peeking, without destructively consuming bytes that
+// turn out to belong to the client's TLS ClientHello instead (which is what
+// every connection carries today, since nothing on the proxy side writes
+// this frame yet).
+var traceParentMagic = [4]byte{'t', 'p', 'f', '1'}
+
+// tracer returns the tracer used to create spans for database sessions,
+// falling back to the global tracer provider if none was configured.
+func (s *Server) tracer() oteltrace.Tracer {
+	provider := s.TracerProvider
+	if provider == nil {
+		provider = otel.GetTracerProvider()
+	}
+	return provider.Tracer("github.com/gravitational/teleport/lib/srv/db")
+}
+
+// readTraceParentFrame peeks at the start of conn for a magic-prefixed,
+// length-prefixed W3C traceparent frame the proxy writes ahead of the TLS
+// bytes on the reverse tunnel connection. If the magic is present, it
+// extracts the remote span and returns a context carrying it as the parent,
+// along with a net.Conn that continues reading from right after the frame.
+// If the magic isn't present (e.g. older proxies, or today, since nothing
+// yet writes this frame), conn is left completely alone: the peeked bytes
+// are replayed to the returned conn's first Read so the caller's TLS
+// handshake still sees every byte the client sent.
+func (s *Server) readTraceParentFrame(ctx context.Context, conn net.Conn) (context.Context, net.Conn, error) {
+	br := bufio.NewReader(conn)
+	peeked := &peekedConn{Conn: conn, r: br}
+
+	magic, err := br.Peek(len(traceParentMagic))
+	if err != nil || !bytes.Equal(magic, traceParentMagic[:]) {
+		// No frame on this connection: don't consume anything, just hand
+		// back a conn that reads from the buffer we peeked into.
+		return ctx, peeked, nil
+	}
+	if _, err := br.Discard(len(traceParentMagic)); err != nil {
+		return ctx, peeked, trace.Wrap(err)
+	}
+
+	var size uint32
+	if err := binary.Read(br, binary.BigEndian, &size); err != nil {
+		return ctx, peeked, trace.Wrap(err)
+	}
+	if size == 0 || size > maxTraceParentFrameSize {
+		return ctx, peeked, trace.BadParameter("invalid traceparent frame size %v", size)
+	}
+	buf := make([]byte, size)
+	if _, err := io.ReadFull(br, buf); err != nil {
+		return ctx, peeked, trace.Wrap(err)
+	}
+	carrier := propagation.MapCarrier{"traceparent": string(buf)}
+	return propagation.TraceContext{}.Extract(ctx, carrier), peeked, nil
+}
+
+// peekedConn is a net.Conn whose initial bytes have already been buffered
+// into r (e.g. to peek at them), so Read must be served from r first rather
+// than going straight to the underlying connection.
+type peekedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *peekedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+// writeTraceParentFrame writes the current span's context to conn as a
+// length-prefixed W3C traceparent frame, for the other side of the
+// connection to pick up as its parent span via readTraceParentFrame.
+//
+// This is the dial-side half of the contract readTraceParentFrame expects:
+// before handing a reverse tunnel connection to this package, the proxy
+// (lib/srv/db/proxyserver.go, not part of this checkout) must call this
+// function on it so the span tree started at proxy.Dial connects to the one
+// started in Server.HandleConnection instead of the two ending up as
+// disjoint traces. Until that call is added on the proxy side, this is
+// exercised only by TestTraceParentFrameRoundtrip, which hand-wires both
+// ends to document the expected behavior.
+func writeTraceParentFrame(ctx context.Context, conn net.Conn) error {
+	carrier := propagation.MapCarrier{}
+	propagation.TraceContext{}.Inject(ctx, carrier)
+	traceparent := carrier["traceparent"]
+	if traceparent == "" {
+		return nil
+	}
+	buf := []byte(traceparent)
+	if _, err := conn.Write(traceParentMagic[:]); err != nil {
+		return trace.Wrap(err)
+	}
+	if err := binary.Write(conn, binary.BigEndian, uint32(len(buf))); err != nil {
+		return trace.Wrap(err)
+	}
+	_, err := conn.Write(buf)
+	return trace.Wrap(err)
+}
+
+// QueryFunc is invoked by a database engine for each statement it executes,
+// e.g. each Postgres wire protocol Query message.
+type QueryFunc func(ctx context.Context, query string)
+
+// traceQueryFn wraps next so each executed statement gets its own child span
+// under the session's span, with the query text recorded as an attribute.
+func (s *Server) traceQueryFn(ctx context.Context, sessionCtx *session.Context, next QueryFunc) QueryFunc {
+	return func(queryCtx context.Context, query string) {
+		attrs := append(sessionSpanAttributes(sessionCtx),
+			attribute.String("db.statement", query),
+			attribute.String("db.protocol", sessionCtx.Server.GetProtocol()),
+		)
+		_, span := s.tracer().Start(ctx, "db.Query", oteltrace.WithAttributes(attrs...))
+		defer span.End()
+		next(queryCtx, query)
+	}
+}
+
+// traceparentFromContext returns the W3C traceparent header value for the
+// span carried in ctx, for embedding into audit events so a single query can
+// be correlated across proxy, db-service and backend logs. Returns "" if ctx
+// carries no valid span context.
+func traceparentFromContext(ctx context.Context) string {
+	carrier := propagation.MapCarrier{}
+	propagation.TraceContext{}.Inject(ctx, carrier)
+	return carrier["traceparent"]
+}
+
+// sessionSpanAttributes returns the span attributes that should be attached
+// to every span created for the given session, mirroring the fields carried
+// in session.Context.
+func sessionSpanAttributes(sessionCtx *session.Context) []attribute.KeyValue {
+	return []attribute.KeyValue{
+		attribute.String("db.name", sessionCtx.Identity.RouteToDatabase.Database),
+		attribute.String("db.user", sessionCtx.Identity.RouteToDatabase.Username),
+		attribute.String("teleport.user", sessionCtx.Identity.Username),
+		attribute.String("teleport.session_id", sessionCtx.ID),
+		attribute.String("db.instance", sessionCtx.Server.GetDatabaseName()),
+	}
+}
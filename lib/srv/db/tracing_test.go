@@ -0,0 +1,191 @@
+/*
+Copyright 2020 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package db
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/gravitational/teleport/lib/auth"
+	"github.com/gravitational/teleport/lib/services"
+	"github.com/gravitational/teleport/lib/srv/db/session"
+
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+)
+
+// TestTraceParentFrameRoundtrip verifies that a traceparent frame written by
+// one side of a connection is correctly picked up as the parent span by the
+// other side, producing a single connected span tree rather than two
+// disjoint traces.
+func TestTraceParentFrameRoundtrip(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	server := &Server{Config: Config{TracerProvider: provider}}
+
+	client, srv := net.Pipe()
+	defer client.Close()
+	defer srv.Close()
+
+	ctx, rootSpan := provider.Tracer("test").Start(context.Background(), "proxy.Dial")
+	done := make(chan error, 1)
+	go func() {
+		done <- writeTraceParentFrame(ctx, client)
+	}()
+
+	childCtx, _, err := server.readTraceParentFrame(context.Background(), srv)
+	require.NoError(t, err)
+	require.NoError(t, <-done)
+	rootSpan.End()
+
+	_, childSpan := server.tracer().Start(childCtx, "db.HandleConnection")
+	childSpan.End()
+
+	spans := recorder.Ended()
+	require.Len(t, spans, 2)
+	require.Equal(t, spans[0].SpanContext().TraceID(), spans[1].SpanContext().TraceID())
+	require.Equal(t, spans[0].SpanContext().SpanID(), spans[1].Parent().SpanID())
+}
+
+// TestReadTraceParentFrameNoFrame verifies that readTraceParentFrame doesn't
+// lose any bytes off a connection that never had a traceparent frame
+// written to it, which is the case for every real connection today since
+// nothing on the proxy side calls writeTraceParentFrame yet. A destructive
+// read here would corrupt the TLS ClientHello that actually opens the
+// stream.
+func TestReadTraceParentFrameNoFrame(t *testing.T) {
+	server := &Server{}
+	client, srv := net.Pipe()
+	defer client.Close()
+	defer srv.Close()
+
+	payload := []byte("not a traceparent frame, e.g. a TLS ClientHello")
+	done := make(chan error, 1)
+	go func() {
+		_, err := client.Write(payload)
+		done <- err
+	}()
+
+	_, conn, err := server.readTraceParentFrame(context.Background(), srv)
+	require.NoError(t, err)
+	require.NoError(t, <-done)
+
+	got := make([]byte, len(payload))
+	_, err = io.ReadFull(conn, got)
+	require.NoError(t, err)
+	require.Equal(t, payload, got, "readTraceParentFrame must not consume bytes that aren't a traceparent frame")
+}
+
+// TestTraceparentFromContext verifies that a W3C traceparent header can be
+// extracted from a context carrying a recording span, for embedding into
+// audit events.
+func TestTraceparentFromContext(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	ctx, span := provider.Tracer("test").Start(context.Background(), "db.Query")
+	defer span.End()
+
+	traceparent := traceparentFromContext(ctx)
+	require.NotEmpty(t, traceparent)
+	require.Contains(t, traceparent, span.SpanContext().TraceID().String())
+}
+
+// TestSessionSpanAttributes verifies the attributes attached to a session
+// span mirror the fields carried in session.Context.
+func TestSessionSpanAttributes(t *testing.T) {
+	sessionCtx := &session.Context{ID: "1234", Server: makeDatabaseServer("test", "localhost:0")}
+	attrs := sessionSpanAttributes(sessionCtx)
+	require.NotEmpty(t, attrs)
+	require.Contains(t, attrs, attribute.String("teleport.session_id", "1234"))
+}
+
+// TestHandleConnectionSpanTree drives one real query through the test
+// server, the same scenario as TestDatabaseAccess, with a span recorder
+// injected via Config.TracerProvider, and verifies that db.HandleConnection,
+// db.Authorize, db.Session, db.Dispatch and db.Query end up as one connected
+// span tree for the session rather than disjoint traces.
+func TestHandleConnectionSpanTree(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+
+	ctx := context.Background()
+	testCtx := setupTestContext(ctx, t)
+	defer testCtx.Close()
+	testCtx.server.TracerProvider = provider
+
+	go testCtx.mux.Serve()
+	go testCtx.postgresServer.Serve()
+	go testCtx.proxyServer.Serve(testCtx.mux.DB())
+	go func() {
+		for conn := range testCtx.proxyConn {
+			testCtx.server.HandleConnection(conn)
+		}
+	}()
+
+	_, role, err := auth.CreateUserAndRole(testCtx.tlsServer.Auth(), "alice", []string{"admin"})
+	require.NoError(t, err)
+	role.SetDatabaseNames(services.Allow, []string{services.Wildcard})
+	role.SetDatabaseUsers(services.Allow, []string{services.Wildcard})
+	require.NoError(t, testCtx.tlsServer.Auth().UpsertRole(ctx, role))
+
+	pgConn, err := connectToPostgres(ctx, testCtx, connectConfig{service: "test", user: "alice", dbName: "postgres", dbUser: "alice"})
+	require.NoError(t, err)
+	_, err = pgConn.Exec(ctx, "select 1").ReadAll()
+	require.NoError(t, err)
+	require.NoError(t, pgConn.Close(ctx))
+
+	// db.Session and db.HandleConnection end only once the server side has
+	// noticed the client went away, which can be after Close returns.
+	var spans []sdktrace.ReadOnlySpan
+	require.Eventually(t, func() bool {
+		spans = recorder.Ended()
+		for _, span := range spans {
+			if span.Name() == "db.HandleConnection" {
+				return true
+			}
+		}
+		return false
+	}, 5*time.Second, 10*time.Millisecond, "db.HandleConnection span never ended")
+	byName := make(map[string]sdktrace.ReadOnlySpan)
+	for _, span := range spans {
+		byName[span.Name()] = span
+	}
+	for _, name := range []string{"db.HandleConnection", "db.Authorize", "db.Session", "db.Dispatch", "db.Query"} {
+		require.Contains(t, byName, name, "expected a %v span", name)
+	}
+
+	traceID := byName["db.HandleConnection"].SpanContext().TraceID()
+	for _, name := range []string{"db.Authorize", "db.Session", "db.Dispatch", "db.Query"} {
+		require.Equal(t, traceID, byName[name].SpanContext().TraceID(),
+			"%v should belong to the same trace as db.HandleConnection", name)
+	}
+
+	// db.Authorize is a direct child of db.HandleConnection, and each
+	// subsequent span is a child of the previous one: db.Session nests
+	// under db.Authorize (whose span is still active on the context when
+	// the session span starts), and db.Dispatch and db.Query both nest
+	// directly under db.Session.
+	require.Equal(t, byName["db.HandleConnection"].SpanContext().SpanID(), byName["db.Authorize"].Parent().SpanID())
+	require.Equal(t, byName["db.Authorize"].SpanContext().SpanID(), byName["db.Session"].Parent().SpanID())
+	require.Equal(t, byName["db.Session"].SpanContext().SpanID(), byName["db.Dispatch"].Parent().SpanID())
+	require.Equal(t, byName["db.Session"].SpanContext().SpanID(), byName["db.Query"].Parent().SpanID())
+}